@@ -36,58 +36,609 @@ import (
 	"code.google.com/p/gopacket/layers"
 	"code.google.com/p/gopacket/pcap"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"github.com/david415/go-netfilter-queue"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	MAX_TTL uint8 = 255
+
+	// magic cookie embedded in the payload of our forged reverse-trace
+	// ICMP echo requests, so we can recognize our own probes if a
+	// router quotes more than the RFC 792 minimum back to us.
+	reverseTraceMagicCookie uint32 = 0xc0ffee15
+
+	// reverseProbeHeaderLen: cookie + ttl + ip version byte, before the
+	// v4-or-v6-sized addresses and ports; see buildReverseProbePayload.
+	reverseProbeHeaderLen = 4 + 1 + 1
+	reverseProbePortsLen  = 2 + 2
+
+	// defaults for NFQueueTraceroute's adaptive per-probe RTT estimator;
+	// see NFQueueTraceObserverOptions.rttEstimatorSeed/rttEstimatorAlpha
+	defaultRTTSeed  time.Duration = 2 * time.Second
+	defaultRTTAlpha float64       = 0.25
+
+	// defaults bounding how many flows FlowTracker will hold onto at
+	// once, and how long a flow may sit idle/completed before its
+	// periodic sweep reaps it; see
+	// NFQueueTraceObserverOptions.maxTrackedFlows/flowEvictAfter
+	defaultMaxTrackedFlows        = 4096
+	defaultFlowEvictAfter         = 5 * time.Minute
+	defaultFlowEvictSweepInterval = 30 * time.Second
 )
 
 // this is a composite struct type called "flowKey"
 // used to track tcp/ip flows... as a hashmap key.
 type flowKey [2]gopacket.Flow
 
-// concurrent-safe hashmap of tcp/ip-flowKeys to NFQueueTraceroute`s
+// flowTrackerOp identifies which operation a flowTrackerRequest wants
+// the FlowTracker actor goroutine to perform against its flowMap.
+type flowTrackerOp int
+
+const (
+	flowTrackerHas flowTrackerOp = iota
+	flowTrackerGet
+	flowTrackerAdd
+	flowTrackerDelete
+)
+
+type flowTrackerRequest struct {
+	op    flowTrackerOp
+	flow  flowKey
+	trace *NFQueueTraceroute
+	reply chan flowTrackerReply
+}
+
+type flowTrackerReply struct {
+	ok    bool
+	trace *NFQueueTraceroute
+}
+
+// FlowTracker owns flowMap from a single goroutine, serving
+// Has/Get/Add/Delete over channels instead of a mutex. A periodic
+// sweep reaps completed or idle NFQueueTraceroute entries.
 type FlowTracker struct {
-	lock    *sync.RWMutex
-	flowMap map[flowKey]*NFQueueTraceroute
+	requests    chan flowTrackerRequest
+	snapshotReq chan chan map[flowKey]*NFQueueTraceroute
+	done        chan struct{}
+
+	maxFlows   int
+	evictAfter time.Duration
 }
 
 func NewFlowTracker() *FlowTracker {
-	return &FlowTracker{
-		lock:    new(sync.RWMutex),
-		flowMap: make(map[flowKey]*NFQueueTraceroute),
+	return NewFlowTrackerWithLimits(defaultMaxTrackedFlows, defaultFlowEvictAfter)
+}
+
+// NewFlowTrackerWithLimits is like NewFlowTracker but lets the caller
+// override the tracked-flow cap and eviction age; see
+// NFQueueTraceObserverOptions.maxTrackedFlows/flowEvictAfter.
+func NewFlowTrackerWithLimits(maxFlows int, evictAfter time.Duration) *FlowTracker {
+	f := &FlowTracker{
+		requests:    make(chan flowTrackerRequest),
+		snapshotReq: make(chan chan map[flowKey]*NFQueueTraceroute),
+		done:        make(chan struct{}),
+		maxFlows:    maxFlows,
+		evictAfter:  evictAfter,
 	}
+	go f.run()
+	return f
+}
+
+func (f *FlowTracker) run() {
+	flowMap := make(map[flowKey]*NFQueueTraceroute)
+	sweep := time.NewTicker(defaultFlowEvictSweepInterval)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case req := <-f.requests:
+			switch req.op {
+			case flowTrackerHas:
+				_, ok := flowMap[req.flow]
+				req.reply <- flowTrackerReply{ok: ok}
+			case flowTrackerGet:
+				trace := flowMap[req.flow]
+				req.reply <- flowTrackerReply{trace: trace}
+			case flowTrackerAdd:
+				if len(flowMap) >= f.maxFlows {
+					f.evictOldest(flowMap)
+				}
+				flowMap[req.flow] = req.trace
+				req.reply <- flowTrackerReply{ok: true}
+			case flowTrackerDelete:
+				delete(flowMap, req.flow)
+				req.reply <- flowTrackerReply{ok: true}
+			}
+		case reply := <-f.snapshotReq:
+			snapshot := make(map[flowKey]*NFQueueTraceroute, len(flowMap))
+			for k, v := range flowMap {
+				snapshot[k] = v
+			}
+			reply <- snapshot
+		case <-sweep.C:
+			f.evictStaleFlows(flowMap)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// evictStaleFlows drops any flow whose trace has already finished, or
+// that has simply been around longer than evictAfter, stopping it
+// first so its reporter still sees a "trace complete" event. Callers
+// must be the run() goroutine.
+func (f *FlowTracker) evictStaleFlows(flowMap map[flowKey]*NFQueueTraceroute) {
+	now := time.Now()
+	for k, trace := range flowMap {
+		if trace.IsStopped() || now.Sub(trace.createdAt) > f.evictAfter {
+			trace.Stop()
+			delete(flowMap, k)
+		}
+	}
+}
+
+// evictOldest makes room for a new flow once the map is at capacity by
+// reaping the single oldest tracked flow. Callers must be the run()
+// goroutine.
+func (f *FlowTracker) evictOldest(flowMap map[flowKey]*NFQueueTraceroute) {
+	var oldestKey flowKey
+	var oldest *NFQueueTraceroute
+	for k, trace := range flowMap {
+		if oldest == nil || trace.createdAt.Before(oldest.createdAt) {
+			oldestKey, oldest = k, trace
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	log.Printf("FlowTracker: at capacity (%d), evicting oldest flow\n", f.maxFlows)
+	oldest.Stop()
+	delete(flowMap, oldestKey)
 }
 
 func (f *FlowTracker) HasFlow(flow flowKey) bool {
-	f.lock.RLock()
-	_, ok := f.flowMap[flow]
-	f.lock.RUnlock()
-	return ok
+	reply := make(chan flowTrackerReply, 1)
+	f.requests <- flowTrackerRequest{op: flowTrackerHas, flow: flow, reply: reply}
+	return (<-reply).ok
 }
 
 func (f *FlowTracker) AddFlow(flow flowKey, nfqTrace *NFQueueTraceroute) {
-	f.lock.Lock()
-	f.flowMap[flow] = nfqTrace
-	f.lock.Unlock()
+	reply := make(chan flowTrackerReply, 1)
+	f.requests <- flowTrackerRequest{op: flowTrackerAdd, flow: flow, trace: nfqTrace, reply: reply}
+	<-reply
 }
 
 func (f *FlowTracker) Delete(flow flowKey) {
-	f.lock.Lock()
-	delete(f.flowMap, flow)
-	f.lock.Unlock()
+	reply := make(chan flowTrackerReply, 1)
+	f.requests <- flowTrackerRequest{op: flowTrackerDelete, flow: flow, reply: reply}
+	<-reply
 }
 
 func (f *FlowTracker) GetFlowTrace(flow flowKey) *NFQueueTraceroute {
-	f.lock.RLock()
-	ret := f.flowMap[flow]
-	f.lock.RUnlock()
-	return ret
+	reply := make(chan flowTrackerReply, 1)
+	f.requests <- flowTrackerRequest{op: flowTrackerGet, flow: flow, reply: reply}
+	return (<-reply).trace
+}
+
+// Snapshot returns a point-in-time copy of every actively tracked
+// flow, letting the reporter subsystem (or anything else) walk active
+// flows without holding a lock on the live map.
+func (f *FlowTracker) Snapshot() map[flowKey]*NFQueueTraceroute {
+	reply := make(chan map[flowKey]*NFQueueTraceroute, 1)
+	f.snapshotReq <- reply
+	return <-reply
+}
+
+// Stop shuts the tracker down: every flow it still holds is stopped
+// (draining its in-flight probes and flushing its reporter) before the
+// actor goroutine itself exits.
+func (f *FlowTracker) Stop() {
+	for _, trace := range f.Snapshot() {
+		trace.Stop()
+	}
+	close(f.done)
+}
+
+// TraceDirection distinguishes a forward-trace hop, observed from the
+// TTL-mangled TCP segments NFQUEUE hands us, from a reverse-trace hop,
+// observed from a reply to one of our forged ICMP Echo Request probes
+// (see runReverseTrace). Both can be reported for the same flow/ttl
+// once NFQueueTraceObserverOptions.reverseTraceEnabled is on, so
+// ReportHop needs a way to tell them apart.
+type TraceDirection int
+
+const (
+	DirectionForward TraceDirection = iota
+	DirectionReverse
+)
+
+func (d TraceDirection) String() string {
+	if d == DirectionReverse {
+		return "reverse"
+	}
+	return "forward"
+}
+
+// TraceReporter receives trace events as they happen, one hop at a
+// time, plus a final "complete" event once a flow's trace finishes.
+// Unlike grepping the log output NFQueueTraceroute also still emits,
+// implementations get structured per-flow events they can act on or
+// forward as-is.
+type TraceReporter interface {
+	ReportHop(flow flowKey, direction TraceDirection, ttl uint8, repeat int, routerIP net.IP, rtt time.Duration)
+	ReportComplete(flow flowKey, result map[uint8][]net.IP)
+}
+
+// TraceReporterCloser is implemented by reporters backed by a sink
+// (a file, a socket) that needs to be flushed/closed on shutdown.
+// NFQueueTraceObserver's shutdown type-asserts for this so it can close the
+// sink only after every in-flight trace has been drained.
+type TraceReporterCloser interface {
+	TraceReporter
+	Close() error
+}
+
+// hopRecord and completeRecord are the two NDJSON record shapes emitted
+// by NDJSONReporter, one JSON object per line.
+type hopRecord struct {
+	Type      string `json:"type"`
+	Direction string `json:"direction"`
+	SrcIP     string `json:"src_ip"`
+	DstIP     string `json:"dst_ip"`
+	SrcPort   string `json:"src_port"`
+	DstPort   string `json:"dst_port"`
+	TTL       uint8  `json:"ttl"`
+	Repeat    int    `json:"repeat"`
+	RouterIP  string `json:"router_ip"`
+	RTTMillis int64  `json:"rtt_ms"`
+}
+
+type completeRecord struct {
+	Type    string             `json:"type"`
+	SrcIP   string             `json:"src_ip"`
+	DstIP   string             `json:"dst_ip"`
+	SrcPort string             `json:"src_port"`
+	DstPort string             `json:"dst_port"`
+	Hops    map[uint8][]string `json:"hops"`
+}
+
+// NDJSONReporter is the built-in TraceReporter: it writes one JSON
+// object per line to an io.Writer, so a caller can point it at a file
+// or socket and parse the result with any off-the-shelf JSON tooling.
+type NDJSONReporter struct {
+	lock *sync.Mutex
+	out  io.Writer
+	enc  *json.Encoder
+}
+
+func NewNDJSONReporter(out io.Writer) *NDJSONReporter {
+	return &NDJSONReporter{
+		lock: new(sync.Mutex),
+		out:  out,
+		enc:  json.NewEncoder(out),
+	}
+}
+
+func flowEndpoints(flow flowKey) (srcIP, dstIP, srcPort, dstPort string) {
+	parts := make([]string, 0, 4)
+	parts = append(parts, flow[0].Src().String(), flow[0].Dst().String(), flow[1].Src().String(), flow[1].Dst().String())
+	return parts[0], parts[1], parts[2], parts[3]
+}
+
+func (r *NDJSONReporter) ReportHop(flow flowKey, direction TraceDirection, ttl uint8, repeat int, routerIP net.IP, rtt time.Duration) {
+	srcIP, dstIP, srcPort, dstPort := flowEndpoints(flow)
+	rec := hopRecord{
+		Type:      "hop",
+		Direction: direction.String(),
+		SrcIP:     srcIP,
+		DstIP:     dstIP,
+		SrcPort:   srcPort,
+		DstPort:   dstPort,
+		TTL:       ttl,
+		Repeat:    repeat,
+		RouterIP:  routerIP.String(),
+		RTTMillis: rtt.Nanoseconds() / int64(time.Millisecond),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		log.Printf("NDJSONReporter.ReportHop: encode error: %s\n", err)
+	}
+}
+
+func (r *NDJSONReporter) ReportComplete(flow flowKey, result map[uint8][]net.IP) {
+	srcIP, dstIP, srcPort, dstPort := flowEndpoints(flow)
+	hops := make(map[uint8][]string, len(result))
+	for ttl, ips := range result {
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		hops[ttl] = addrs
+	}
+	rec := completeRecord{
+		Type:    "trace complete",
+		SrcIP:   srcIP,
+		DstIP:   dstIP,
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Hops:    hops,
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		log.Printf("NDJSONReporter.ReportComplete: encode error: %s\n", err)
+	}
+}
+
+// Close closes the underlying writer if it implements io.Closer, so
+// a file-backed sink gets flushed on shutdown; writers that don't
+// implement io.Closer are left alone.
+func (r *NDJSONReporter) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if c, ok := r.out.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// tracePacket is a single TCP packet to run through processPacket,
+// decoupled from netfilter.NFPacket so the same mangle/accept logic
+// can run whether the packet came from a live NFQUEUE or a
+// pcap.OpenOffline replay. setVerdict delivers the mangle/accept
+// decision back to whatever produced the packet: NFQueueSource
+// forwards it to the kernel, PcapFileSource discards it.
+type tracePacket struct {
+	packet     gopacket.Packet
+	setVerdict func(verdict netfilter.Verdict, mangledBytes []byte)
+}
+
+// icmpReply is a decoded ICMP(v4/v6) Time Exceeded message: the
+// quoted payload is enough to attribute it to either an outstanding
+// reverse-trace probe (via getICMPEchoFromHead) or a tracked forward
+// flow (via getPacketFlow), and timestamp is the time it was captured
+// -- wall-clock for a live capture, pcap capture time for a replay --
+// so RTTs stay correct either way.
+type icmpReply struct {
+	srcIP     net.IP
+	payload   []byte
+	timestamp time.Time
+}
+
+// TraceSource supplies NFQueueTraceObserver with the two packet
+// streams it needs: TCP segments to mangle/observe for the forward
+// trace, and ICMP(v6) Time Exceeded replies to correlate back to a
+// tracked flow or an outstanding reverse-trace probe. NFQueueSource is
+// the live path; PcapFileSource reads both out of a single
+// pcap.OpenOffline capture instead, so the mangling/decoding logic can
+// be regression-tested without root or a live NIC.
+type TraceSource interface {
+	Packets() <-chan tracePacket
+	ICMPReplies() <-chan icmpReply
+	Close()
+}
+
+// NFQueueSource is the live TraceSource: TCP packets arrive over a
+// netfilter.NFQueue fed by an iptables NFQUEUE rule, and ICMP(v6)
+// replies are sniffed off the wire with a live pcap handle on iface.
+type NFQueueSource struct {
+	nfq        *netfilter.NFQueue
+	icmpHandle *pcap.Handle
+
+	packets chan tracePacket
+	replies chan icmpReply
+}
+
+// NewNFQueueSource opens the NFQUEUE and a live pcap handle on iface
+// for sniffing ICMP replies.
+func NewNFQueueSource(iface string) (*NFQueueSource, error) {
+	// XXX adjust these parameters
+	nfq, err := netfilter.NewNFQueue(0, 100, netfilter.NF_DEFAULT_PACKET_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := pcap.OpenLive(iface, 65536, true, pcap.BlockForever)
+	if err != nil {
+		nfq.Close()
+		return nil, err
+	}
+	if err := handle.SetBPFFilter("icmp or icmp6"); err != nil {
+		nfq.Close()
+		handle.Close()
+		return nil, err
+	}
+
+	s := &NFQueueSource{
+		nfq:        nfq,
+		icmpHandle: handle,
+		packets:    make(chan tracePacket),
+		replies:    make(chan icmpReply),
+	}
+	go s.relayPackets()
+	go s.relayReplies()
+	return s, nil
+}
+
+// relayPackets wraps every packet the kernel hands us over NFQUEUE in
+// a tracePacket whose setVerdict delivers the mangle/accept decision
+// straight back to the kernel.
+func (s *NFQueueSource) relayPackets() {
+	for p := range s.nfq.GetPackets() {
+		p := p
+		s.packets <- tracePacket{
+			packet: p.Packet,
+			setVerdict: func(v netfilter.Verdict, mangledBytes []byte) {
+				if mangledBytes != nil {
+					p.SetModifiedVerdict(v, mangledBytes)
+					return
+				}
+				p.SetVerdict(v)
+			},
+		}
+	}
+	close(s.packets)
+}
+
+// relayReplies decodes every ICMP(v4/v6) packet seen on the wire and
+// forwards the Time Exceeded ones, using the pcap capture timestamp
+// rather than wall-clock time at decode time so RTTs reported below
+// stay accurate under load.
+func (s *NFQueueSource) relayReplies() {
+	var eth layers.Ethernet
+	var ip4 layers.IPv4
+	var ip6 layers.IPv6
+	var icmp4 layers.ICMPv4
+	var icmp6 layers.ICMPv6
+	var payload gopacket.Payload
+	decoded := make([]gopacket.LayerType, 0, 5)
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &ip6, &icmp4, &icmp6, &payload)
+
+	for {
+		data, ci, err := s.icmpHandle.ReadPacketData()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			continue
+		}
+		if err := parser.DecodeLayers(data, &decoded); err != nil {
+			continue
+		}
+
+		var srcIP net.IP
+		isTimeExceeded := false
+		for _, layerType := range decoded {
+			switch layerType {
+			case layers.LayerTypeIPv4:
+				srcIP = ip4.SrcIP
+			case layers.LayerTypeIPv6:
+				srcIP = ip6.SrcIP
+			case layers.LayerTypeICMPv4:
+				isTimeExceeded = uint8(icmp4.TypeCode>>8) == layers.ICMPv4TypeTimeExceeded
+			case layers.LayerTypeICMPv6:
+				isTimeExceeded = uint8(icmp6.TypeCode>>8) == layers.ICMPv6TypeTimeExceeded
+			}
+		}
+		if !isTimeExceeded {
+			continue
+		}
+		s.replies <- icmpReply{srcIP: srcIP, payload: []byte(payload), timestamp: ci.Timestamp}
+	}
+	close(s.replies)
+}
+
+func (s *NFQueueSource) Packets() <-chan tracePacket   { return s.packets }
+func (s *NFQueueSource) ICMPReplies() <-chan icmpReply { return s.replies }
+
+func (s *NFQueueSource) Close() {
+	s.nfq.Close()
+	s.icmpHandle.Close()
+}
+
+// observeOnlyVerdict is the setVerdict every tracePacket produced from
+// a pcap file carries: there's no NFQUEUE connection behind a replay,
+// so processPacket's mangle decision only drives its usual bookkeeping
+// (probe timers, TTL advancement) and is never actually issued
+// anywhere.
+func observeOnlyVerdict(netfilter.Verdict, []byte) {}
+
+// PcapFileSource is the offline TraceSource: it replays a single
+// pcap.OpenOffline capture, applying a "tcp or icmp or icmp6" BPF
+// filter and demultiplexing each packet the same way NFQueueSource's
+// two live streams do -- TCP segments run through processPacket in
+// observeOnlyVerdict's no-mangle mode, and ICMP(v6) Time Exceeded
+// packets feed replyReceived/reverseReplyReceived with the pcap
+// capture timestamp rather than wall-clock time, so a replay
+// reproduces the RTTs from the original capture.
+type PcapFileSource struct {
+	handle  *pcap.Handle
+	packets chan tracePacket
+	replies chan icmpReply
+}
+
+func NewPcapFileSource(fname string) (*PcapFileSource, error) {
+	handle, err := pcap.OpenOffline(fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter("tcp or icmp or icmp6"); err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	s := &PcapFileSource{
+		handle:  handle,
+		packets: make(chan tracePacket),
+		replies: make(chan icmpReply),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *PcapFileSource) run() {
+	for {
+		data, ci, err := s.handle.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+
+		if pkt.Layer(layers.LayerTypeTCP) != nil {
+			s.packets <- tracePacket{packet: pkt, setVerdict: observeOnlyVerdict}
+			continue
+		}
+
+		var srcIP net.IP
+		if ip4Layer := pkt.Layer(layers.LayerTypeIPv4); ip4Layer != nil {
+			srcIP = ip4Layer.(*layers.IPv4).SrcIP
+		} else if ip6Layer := pkt.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
+			srcIP = ip6Layer.(*layers.IPv6).SrcIP
+		}
+
+		isTimeExceeded := false
+		if icmp4Layer := pkt.Layer(layers.LayerTypeICMPv4); icmp4Layer != nil {
+			icmp4 := icmp4Layer.(*layers.ICMPv4)
+			isTimeExceeded = uint8(icmp4.TypeCode>>8) == layers.ICMPv4TypeTimeExceeded
+		} else if icmp6Layer := pkt.Layer(layers.LayerTypeICMPv6); icmp6Layer != nil {
+			icmp6 := icmp6Layer.(*layers.ICMPv6)
+			isTimeExceeded = uint8(icmp6.TypeCode>>8) == layers.ICMPv6TypeTimeExceeded
+		}
+		if !isTimeExceeded || srcIP == nil {
+			continue
+		}
+
+		var payload []byte
+		if appLayer := pkt.ApplicationLayer(); appLayer != nil {
+			payload = appLayer.Payload()
+		}
+		s.replies <- icmpReply{srcIP: srcIP, payload: payload, timestamp: ci.Timestamp}
+	}
+	close(s.packets)
+	close(s.replies)
+}
+
+func (s *PcapFileSource) Packets() <-chan tracePacket   { return s.packets }
+func (s *PcapFileSource) ICMPReplies() <-chan icmpReply { return s.replies }
+
+func (s *PcapFileSource) Close() {
+	s.handle.Close()
 }
 
 type NFQueueTraceObserverOptions struct {
@@ -96,6 +647,47 @@ type NFQueueTraceObserverOptions struct {
 	ttlMax       uint8
 	ttlRepeatMax int
 	mangleFreq   int
+
+	// pcapFile, if set, switches NewNFQueueTraceObserver from the live
+	// NFQUEUE path over to replaying a prior capture through
+	// PcapFileSource instead -- useful for regression testing the
+	// mangling/decoding logic without root or a live NIC. iface is
+	// ignored when this is set.
+	pcapFile string
+
+	// reverseTraceEnabled turns on the forged ICMP Echo Request based
+	// reverse-path probing, letting us enumerate hops on the
+	// server-to-client path even when the client sits behind NAT.
+	reverseTraceEnabled bool
+	reverseProbeFreq    time.Duration
+
+	// reporter receives per-hop and trace-complete events for every
+	// flow. Defaults to an NDJSONReporter writing to stdout.
+	reporter TraceReporter
+
+	// rttEstimatorSeed/rttEstimatorAlpha configure each flow's adaptive
+	// per-probe timeout: the EWMA is seeded with rttEstimatorSeed and
+	// smoothed by rttEstimatorAlpha on every observed sample. Zero
+	// values fall back to defaultRTTSeed/defaultRTTAlpha.
+	rttEstimatorSeed  time.Duration
+	rttEstimatorAlpha float64
+
+	// maxTrackedFlows/flowEvictAfter bound the FlowTracker's memory
+	// use; zero values fall back to
+	// defaultMaxTrackedFlows/defaultFlowEvictAfter.
+	maxTrackedFlows int
+	flowEvictAfter  time.Duration
+}
+
+// icmpProbeRecord correlates a forged reverse-trace ICMP Echo Request
+// (identified by the id/seq we chose when sending it) back to the flow
+// and ttl it was sent for, so that we can attribute an incoming Time
+// Exceeded reply even when the router only quotes the RFC 792 minimum
+// 64 bits of our probe (i.e. no payload, just the ICMP echo header).
+type icmpProbeRecord struct {
+	flow   flowKey
+	ttl    uint8
+	sentAt time.Time
 }
 
 type NFQueueTraceObserver struct {
@@ -103,135 +695,603 @@ type NFQueueTraceObserver struct {
 	options NFQueueTraceObserverOptions
 
 	flowTracker *FlowTracker
-	nfq         *netfilter.NFQueue
 
-	// packet channel for interacting with NFQueue
-	packets <-chan netfilter.NFPacket
+	// source supplies our TCP packets and ICMP replies, either from a
+	// live NFQUEUE/pcap handle or a pcap.OpenOffline replay; see
+	// NFQueueTraceObserverOptions.pcapFile.
+	source TraceSource
 
 	// this is used to stop all the traceroutes
 	done chan bool
 
-	// signal our calling party that we are finished
-	// XXX get rid of this?
+	// closed once the observer has fully shut down, whether via Stop()
+	// or (for a PcapFileSource replay) the capture running out of
+	// packets, so callers like main() can block on it
 	finished chan bool
+
+	// outstanding reverse-trace ICMP echo probes, keyed by the icmp
+	// echo identifier/sequence pair we sent them with
+	reverseProbesLock *sync.RWMutex
+	reverseProbes     map[uint32]icmpProbeRecord
+
+	// sends the forged reverse-trace ICMP Echo Request probes; see
+	// icmpProber
+	icmpProber icmpProber
 }
 
 func NewNFQueueTraceObserver(options NFQueueTraceObserverOptions) *NFQueueTraceObserver {
 	var err error
 	o := NFQueueTraceObserver{
-		options:  options,
-		done:     make(chan bool),
-		finished: make(chan bool),
+		options:           options,
+		done:              make(chan bool),
+		finished:          make(chan bool),
+		reverseProbesLock: new(sync.RWMutex),
+		reverseProbes:     make(map[uint32]icmpProbeRecord),
 	}
 
-	flowTracker := NewFlowTracker()
-	o.flowTracker = flowTracker
-	// XXX adjust these parameters
-	o.nfq, err = netfilter.NewNFQueue(0, 100, netfilter.NF_DEFAULT_PACKET_SIZE)
+	if o.options.reporter == nil {
+		o.options.reporter = NewNDJSONReporter(os.Stdout)
+	}
+	if o.options.rttEstimatorSeed == 0 {
+		o.options.rttEstimatorSeed = defaultRTTSeed
+	}
+	if o.options.rttEstimatorAlpha == 0 {
+		o.options.rttEstimatorAlpha = defaultRTTAlpha
+	}
+	if o.options.maxTrackedFlows == 0 {
+		o.options.maxTrackedFlows = defaultMaxTrackedFlows
+	}
+	if o.options.flowEvictAfter == 0 {
+		o.options.flowEvictAfter = defaultFlowEvictAfter
+	}
+
+	o.flowTracker = NewFlowTrackerWithLimits(o.options.maxTrackedFlows, o.options.flowEvictAfter)
+	if o.options.pcapFile != "" {
+		o.source, err = NewPcapFileSource(o.options.pcapFile)
+	} else {
+		o.source, err = NewNFQueueSource(o.options.iface)
+	}
 	if err != nil {
 		panic(err)
 	}
-	o.packets = o.nfq.GetPackets()
+
+	if o.options.reverseTraceEnabled {
+		o.icmpProber, err = newICMPProber()
+		if err != nil {
+			panic(err)
+		}
+	}
 	return &o
 }
 
 func (o *NFQueueTraceObserver) Start() {
-	o.startReceivingReplies()
+	packets := o.source.Packets()
+	replies := o.source.ICMPReplies()
+
+	finish := func() {
+		o.source.Close()
+		o.shutdown()
+		close(o.done)
+		close(o.finished)
+	}
+
 	go func() {
-		for true {
+		for {
 			select {
-			case p := <-o.packets:
+			case p, ok := <-packets:
+				if !ok {
+					packets = nil
+					if replies == nil {
+						finish()
+						return
+					}
+					break
+				}
 				o.processPacket(p)
+			case r, ok := <-replies:
+				if !ok {
+					replies = nil
+					if packets == nil {
+						finish()
+						return
+					}
+					break
+				}
+				o.processICMPReply(r)
 			case <-o.done:
-				o.nfq.Close()
-				close(o.done) // XXX necessary?
-				// XXX todo: stop other goroutines
-				break
+				finish()
+				return
 			}
 		}
 	}()
 }
 
+// shutdown drains every in-flight trace -- each NFQueueTraceroute.Stop()
+// call flushes its final "trace complete" event to the reporter -- and
+// only then closes the reporter's underlying sink, so shutdown never
+// drops or interleaves output with a closed writer.
+func (o *NFQueueTraceObserver) shutdown() {
+	o.flowTracker.Stop()
+	if closer, ok := o.options.reporter.(TraceReporterCloser); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("shutdown: error closing reporter: %s\n", err)
+		}
+	}
+	if o.icmpProber != nil {
+		if err := o.icmpProber.Close(); err != nil {
+			log.Printf("shutdown: error closing icmpProber: %s\n", err)
+		}
+	}
+}
+
 func (o *NFQueueTraceObserver) Stop() {
 	o.done <- true
 }
 
 // XXX make the locking more efficient?
-func (o *NFQueueTraceObserver) processPacket(p netfilter.NFPacket) {
-	ipLayer := p.Packet.Layer(layers.LayerTypeIPv4)
-	tcpLayer := p.Packet.Layer(layers.LayerTypeTCP)
-	if ipLayer == nil || tcpLayer == nil {
-		// ignore non-tcp/ip packets
+func (o *NFQueueTraceObserver) processPacket(tp tracePacket) {
+	tcpLayer := tp.packet.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		// ignore non-tcp packets
 		return
 	}
-	ip, _ := ipLayer.(*layers.IPv4)
 	tcp, _ := tcpLayer.(*layers.TCP)
 
-	flow := flowKey{ip.NetworkFlow(), tcp.TransportFlow()}
+	var netFlow gopacket.Flow
+	var clientIP, serverIP net.IP
+	if ipLayer := tp.packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip, _ := ipLayer.(*layers.IPv4)
+		netFlow = ip.NetworkFlow()
+		clientIP, serverIP = ip.SrcIP, ip.DstIP
+	} else if ip6Layer := tp.packet.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
+		ip6, _ := ip6Layer.(*layers.IPv6)
+		netFlow = ip6.NetworkFlow()
+		clientIP, serverIP = ip6.SrcIP, ip6.DstIP
+	} else {
+		// ignore non-ip packets
+		return
+	}
+
+	flow := flowKey{netFlow, tcp.TransportFlow()}
 	if o.flowTracker.HasFlow(flow) == false {
-		nfqTrace := NewNFQueueTraceroute(o.options.ttlMax, o.options.ttlRepeatMax, o.options.mangleFreq)
+		nfqTrace := NewNFQueueTracerouteWithRTT(o.options.ttlMax, o.options.ttlRepeatMax, o.options.mangleFreq, flow, o.options.reporter, o.options.rttEstimatorSeed, o.options.rttEstimatorAlpha)
 		o.flowTracker.AddFlow(flow, nfqTrace)
+		if o.options.reverseTraceEnabled {
+			go o.runReverseTrace(flow, nfqTrace, serverIP, clientIP)
+		}
 	}
 	nfqTrace := o.flowTracker.GetFlowTrace(flow)
-	nfqTrace.processPacket(p)
+	nfqTrace.processPacket(tp)
 }
 
-// return a net.IP channel to report all the ICMP reponse SrcIP addresses
-// that have the ICMP time exceeded flag set
-func (o *NFQueueTraceObserver) startReceivingReplies() {
-	snaplen := 65536
-	filter := "icmp" // the idea here is to capture only ICMP packets
+// runReverseTrace periodically fires off forged ICMP Echo Request
+// probes of increasing TTL, spoofed as serverIP->clientIP, to trace
+// the reverse path. Each probe's id/seq is recorded in
+// o.reverseProbes so processICMPReply can match a later reply back to
+// (flow, ttl).
+func (o *NFQueueTraceObserver) runReverseTrace(flow flowKey, nfqTrace *NFQueueTraceroute, serverIP, clientIP net.IP) {
+	ticker := time.NewTicker(o.options.reverseProbeFreq)
+	defer ticker.Stop()
 
-	var eth layers.Ethernet
-	var ip layers.IPv4
-	var icmp layers.ICMPv4
-	var payload gopacket.Payload
-	var flow flowKey
+	for ttl := uint8(1); ttl <= o.options.ttlMax; ttl++ {
+		select {
+		case <-ticker.C:
+		case <-nfqTrace.reverseDone:
+			return
+		}
+		if nfqTrace.IsStopped() {
+			return
+		}
+		id, seq := nfqTrace.nextReverseProbeID()
+		o.reverseProbesLock.Lock()
+		o.reverseProbes[reverseProbeKey(id, seq)] = icmpProbeRecord{flow: flow, ttl: ttl, sentAt: time.Now()}
+		o.reverseProbesLock.Unlock()
+
+		if err := o.sendICMPEchoProbe(flow, serverIP, clientIP, ttl, id, seq); err != nil {
+			log.Printf("runReverseTrace: sendICMPEchoProbe error: %s\n", err)
+		}
+	}
+}
 
-	decoded := make([]gopacket.LayerType, 0, 4)
+// reverseProbeKey packs an ICMP echo identifier/sequence pair into a
+// single map key.
+func reverseProbeKey(id, seq uint16) uint32 {
+	return uint32(id)<<16 | uint32(seq)
+}
 
-	handle, err := pcap.OpenLive(o.options.iface, int32(snaplen), true, pcap.BlockForever)
+// buildReverseProbePayload encodes our magic cookie plus the flow and
+// ttl a forged reverse-trace probe is being sent for; see
+// reverseProbeHeaderLen/reverseProbePortsLen and reverseFlowFromPayload.
+func buildReverseProbePayload(flow flowKey, ttl uint8) []byte {
+	src, dst := flow[0].Src().Raw(), flow[0].Dst().Raw()
+	addrLen := len(src)
+	payload := make([]byte, reverseProbeHeaderLen+2*addrLen+reverseProbePortsLen)
+	binary.BigEndian.PutUint32(payload[0:4], reverseTraceMagicCookie)
+	payload[4] = ttl
+	if addrLen == net.IPv6len {
+		payload[5] = 6
+	} else {
+		payload[5] = 4
+	}
+	off := reverseProbeHeaderLen
+	off += copy(payload[off:], src)
+	off += copy(payload[off:], dst)
+	copy(payload[off:], flow[1].Src().Raw())
+	copy(payload[off+2:], flow[1].Dst().Raw())
+	return payload
+}
+
+// reverseFlowFromPayload is buildReverseProbePayload's inverse; it only
+// succeeds when a router quoted more than the RFC 792 minimum 64 bits.
+// processICMPReply falls back to it when the id/seq lookup into
+// o.reverseProbes misses.
+func reverseFlowFromPayload(payload []byte) (flowKey, uint8, bool) {
+	if len(payload) < reverseProbeHeaderLen || binary.BigEndian.Uint32(payload[0:4]) != reverseTraceMagicCookie {
+		return flowKey{}, 0, false
+	}
+	var addrLen int
+	var endpointType gopacket.EndpointType
+	switch payload[5] {
+	case 4:
+		addrLen, endpointType = net.IPv4len, layers.EndpointIPv4
+	case 6:
+		addrLen, endpointType = net.IPv6len, layers.EndpointIPv6
+	default:
+		return flowKey{}, 0, false
+	}
+	if len(payload) < reverseProbeHeaderLen+2*addrLen+reverseProbePortsLen {
+		return flowKey{}, 0, false
+	}
+	off := reverseProbeHeaderLen
+	src, dst := payload[off:off+addrLen], payload[off+addrLen:off+2*addrLen]
+	off += 2 * addrLen
+	netFlow := gopacket.NewFlow(endpointType, src, dst)
+	tcpFlow := gopacket.NewFlow(layers.EndpointTCPPort, payload[off:off+2], payload[off+2:off+4])
+	return flowKey{netFlow, tcpFlow}, payload[4], true
+}
+
+// sendICMPEchoProbe forges and sends an ICMP Echo Request with the
+// given TTL, spoofing its source address as serverIP and addressing it
+// to clientIP. The payload carries our magic cookie plus the flow/ttl
+// the probe was sent for (see buildReverseProbePayload).
+func (o *NFQueueTraceObserver) sendICMPEchoProbe(flow flowKey, serverIP, clientIP net.IP, ttl uint8, id, seq uint16) error {
+	payload := buildReverseProbePayload(flow, ttl)
+	return o.icmpProber.sendEcho(serverIP, clientIP, ttl, id, seq, payload)
+}
+
+// icmpProber sends the forged ICMP Echo Request probes runReverseTrace
+// fires off. rawICMPv4Prober spoofs the source address (root-only,
+// IPv4 only); portableICMPProber is the unprivileged dual-stack
+// fallback that can't spoof. multiPathICMPProber picks between them
+// per-packet by address family.
+type icmpProber interface {
+	sendEcho(srcIP, dstIP net.IP, ttl uint8, id, seq uint16, payload []byte) error
+	Close() error
+}
+
+// newICMPProber opens the best available way to send reverse-trace
+// probes: a spoofing-capable raw IPv4 socket when we have the
+// privilege for one, alongside the portable non-privileged fallback
+// that handles everything else (including all of IPv6, since raw IPv6
+// header injection isn't available the same portable way IPv4's
+// IP_HDRINCL is).
+func newICMPProber() (icmpProber, error) {
+	fallback, err := newPortableICMPProber()
 	if err != nil {
-		log.Fatal("error opening pcap handle: ", err)
+		return nil, err
 	}
-	if err := handle.SetBPFFilter(filter); err != nil {
-		log.Fatal("error setting BPF filter: ", err)
+	v4, err := newRawICMPv4Prober()
+	if err != nil {
+		log.Printf("newICMPProber: no raw ICMPv4 socket (%s); IPv4 reverse-trace probes will use the unprivileged fallback and won't be able to spoof their source address\n", err)
+		v4 = nil
 	}
+	return &multiPathICMPProber{v4: v4, fallback: fallback}, nil
+}
 
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip, &icmp, &payload)
+type multiPathICMPProber struct {
+	v4       icmpProber // nil if we couldn't get a raw IPv4 socket
+	fallback icmpProber
+}
 
-	go func() {
-		for true {
-			data, _, err := handle.ReadPacketData()
-			if err != nil {
-				continue
-			}
-			err = parser.DecodeLayers(data, &decoded)
-			if err != nil {
-				continue
-			}
-			typ := uint8(icmp.TypeCode >> 8)
-			if typ != layers.ICMPv4TypeTimeExceeded {
-				continue
-			}
+func (p *multiPathICMPProber) sendEcho(srcIP, dstIP net.IP, ttl uint8, id, seq uint16, payload []byte) error {
+	if p.v4 != nil && dstIP.To4() != nil {
+		return p.v4.sendEcho(srcIP, dstIP, ttl, id, seq, payload)
+	}
+	return p.fallback.sendEcho(srcIP, dstIP, ttl, id, seq, payload)
+}
 
-			// XXX todo: check that the IP header protocol value is set to TCP
-			flow = getPacketFlow(payload)
+func (p *multiPathICMPProber) Close() error {
+	var err error
+	if p.v4 != nil {
+		err = p.v4.Close()
+	}
+	if fallbackErr := p.fallback.Close(); err == nil {
+		err = fallbackErr
+	}
+	return err
+}
+
+type rawICMPv4Prober struct {
+	conn *ipv4.RawConn
+}
+
+func newRawICMPv4Prober() (*rawICMPv4Prober, error) {
+	packetConn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ipv4.NewRawConn(packetConn)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	return &rawICMPv4Prober{conn: conn}, nil
+}
+
+func (p *rawICMPv4Prober) sendEcho(srcIP, dstIP net.IP, ttl uint8, id, seq uint16, payload []byte) error {
+	if srcIP.To4() == nil || dstIP.To4() == nil {
+		return fmt.Errorf("rawICMPv4Prober: %s -> %s is not an IPv4 address pair", srcIP, dstIP)
+	}
+	echo := layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		Id:       id,
+		Seq:      seq,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, &echo, gopacket.Payload(payload)); err != nil {
+		return err
+	}
 
-			// XXX it feels dirty to have the mutex around the hashmap
-			// i'm thinking about using channels instead...
-			if o.flowTracker.HasFlow(flow) == false {
-				// ignore ICMP ttl expire packets that are for flows other than the ones we are currently tracking
-				continue
+	header := &ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(buf.Bytes()),
+		TTL:      int(ttl),
+		Protocol: 1, // ICMP
+		Src:      srcIP,
+		Dst:      dstIP,
+	}
+	return p.conn.WriteTo(header, buf.Bytes(), nil)
+}
+
+func (p *rawICMPv4Prober) Close() error {
+	return p.conn.Close()
+}
+
+// portableICMPProber sends unspoofed ICMP Echo Requests over a pair of
+// non-privileged "udp4"/"udp6" ICMP sockets (see golang.org/x/net/icmp),
+// which works without root on both Linux and Darwin. sendEcho ignores
+// srcIP: the kernel always stamps the socket's real local address.
+type portableICMPProber struct {
+	conn4 *icmp.PacketConn
+	conn6 *icmp.PacketConn
+}
+
+func newPortableICMPProber() (*portableICMPProber, error) {
+	conn4, err4 := icmp.ListenPacket("udp4", "0.0.0.0")
+	conn6, err6 := icmp.ListenPacket("udp6", "::")
+	if err4 != nil && err6 != nil {
+		return nil, fmt.Errorf("portableICMPProber: no IPv4 (%s) or IPv6 (%s) unprivileged ICMP socket available", err4, err6)
+	}
+	return &portableICMPProber{conn4: conn4, conn6: conn6}, nil
+}
+
+func (p *portableICMPProber) sendEcho(srcIP, dstIP net.IP, ttl uint8, id, seq uint16, payload []byte) error {
+	if ip4 := dstIP.To4(); ip4 != nil {
+		if p.conn4 == nil {
+			return fmt.Errorf("portableICMPProber: no IPv4 socket available")
+		}
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho, Code: 0,
+			Body: &icmp.Echo{ID: int(id), Seq: int(seq), Data: payload},
+		}
+		wb, err := msg.Marshal(nil)
+		if err != nil {
+			return err
+		}
+		if err := p.conn4.IPv4PacketConn().SetTTL(int(ttl)); err != nil {
+			return err
+		}
+		_, err = p.conn4.WriteTo(wb, &net.UDPAddr{IP: ip4})
+		return err
+	}
+
+	if p.conn6 == nil {
+		return fmt.Errorf("portableICMPProber: no IPv6 socket available")
+	}
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest, Code: 0,
+		Body: &icmp.Echo{ID: int(id), Seq: int(seq), Data: payload},
+	}
+	wb, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if err := p.conn6.IPv6PacketConn().SetHopLimit(int(ttl)); err != nil {
+		return err
+	}
+	_, err = p.conn6.WriteTo(wb, &net.UDPAddr{IP: dstIP})
+	return err
+}
+
+func (p *portableICMPProber) Close() error {
+	var err error
+	if p.conn4 != nil {
+		err = p.conn4.Close()
+	}
+	if p.conn6 != nil {
+		if err6 := p.conn6.Close(); err == nil {
+			err = err6
+		}
+	}
+	return err
+}
+
+// processICMPReply attributes a decoded ICMP(v6) Time Exceeded reply
+// to whichever probe produced it: an outstanding forged reverse-trace
+// ICMP Echo Request, or a TCP segment belonging to a flow we're
+// already tracing forward. This runs the same regardless of whether r
+// came from NFQueueSource's live pcap handle or PcapFileSource's
+// replay.
+func (o *NFQueueTraceObserver) processICMPReply(r icmpReply) {
+	if id, seq, ok := getICMPEchoFromHead(r.payload); ok {
+		// this Time Exceeded quotes one of our forged reverse-trace
+		// ICMP Echo Request probes rather than a TCP segment
+		o.reverseProbesLock.Lock()
+		rec, ok := o.reverseProbes[reverseProbeKey(id, seq)]
+		if ok {
+			delete(o.reverseProbes, reverseProbeKey(id, seq))
+		}
+		o.reverseProbesLock.Unlock()
+
+		if ok {
+			if o.flowTracker.HasFlow(rec.flow) == false {
+				return
 			}
+			o.flowTracker.GetFlowTrace(rec.flow).reverseReplyReceived(rec.ttl, r.srcIP, r.timestamp.Sub(rec.sentAt))
+			return
+		}
 
-			nfqTrace := o.flowTracker.GetFlowTrace(flow)
-			nfqTrace.replyReceived(ip.SrcIP)
+		// the o.reverseProbes entry is already gone (an earlier reply
+		// to the same probe consumed it) or was never recorded. Fall
+		// back to the flow/ttl we stamped directly into the probe's
+		// echo payload, which follows the quoted inner IP header and
+		// the 8 byte ICMP echo header; we just won't have a send time
+		// for the RTT.
+		innerHeaderLen := 40
+		if r.payload[0]>>4 != 6 {
+			innerHeaderLen = int(r.payload[0]&0x0f) * 4
 		}
-	}()
+		if len(r.payload) < innerHeaderLen+8 {
+			return
+		}
+		if flow, ttl, ok := reverseFlowFromPayload(r.payload[innerHeaderLen+8:]); ok && o.flowTracker.HasFlow(flow) {
+			o.flowTracker.GetFlowTrace(flow).reverseReplyReceived(ttl, r.srcIP, 0)
+		}
+		return
+	}
+
+	// XXX todo: check that the IP header protocol value is set to TCP
+	flow := getPacketFlow(r.payload)
+
+	// XXX it feels dirty to have the mutex around the hashmap
+	// i'm thinking about using channels instead...
+	if o.flowTracker.HasFlow(flow) == false {
+		// ignore ICMP ttl expire packets that are for flows other than the ones we are currently tracking
+		return
+	}
+
+	seq, _ := getQuotedTCPSeq(r.payload)
+
+	nfqTrace := o.flowTracker.GetFlowTrace(flow)
+	nfqTrace.replyReceived(r.srcIP, seq, r.timestamp)
+}
+
+// probeKey identifies one individual (ttl, repeat) probe, i.e. one
+// specific TTL-mangled packet we let through.
+type probeKey struct {
+	ttl    uint8
+	repeat int
+}
+
+const probeHistorySize = 64
+
+type probeRecord struct {
+	key  probeKey
+	seq  uint32
+	sent time.Time
+	used bool
+}
+
+// probeHistory is a small fixed-size ring buffer mapping recent
+// (ttl, repeat) probe identities to the time they were sent and the
+// original TCP sequence number we mangled, so a late-arriving ICMP
+// reply can be attributed to the probe it actually answers -- by
+// looking up the sequence number quoted back to us -- rather than
+// whatever ttl the trace happens to be on by the time the reply shows
+// up.
+type probeHistory struct {
+	lock    *sync.Mutex
+	entries [probeHistorySize]probeRecord
+	next    int
+}
+
+func newProbeHistory() *probeHistory {
+	return &probeHistory{lock: new(sync.Mutex)}
+}
+
+func (h *probeHistory) record(key probeKey, seq uint32, sent time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries[h.next] = probeRecord{key: key, seq: seq, sent: sent, used: true}
+	h.next = (h.next + 1) % probeHistorySize
+}
+
+func (h *probeHistory) lookup(key probeKey) (time.Time, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, e := range h.entries {
+		if e.used && e.key == key {
+			return e.sent, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// lookupBySeq finds the probe whose mangled packet had the given TCP
+// sequence number -- the same number a router quotes back in its Time
+// Exceeded reply -- and returns which (ttl, repeat) it actually was
+// and when we sent it.
+func (h *probeHistory) lookupBySeq(seq uint32) (probeKey, time.Time, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, e := range h.entries {
+		if e.used && e.seq == seq {
+			return e.key, e.sent, true
+		}
+	}
+	return probeKey{}, time.Time{}, false
+}
+
+// rttEstimator keeps an exponentially weighted moving average of
+// observed probe RTTs, seeded with a configurable default, so that
+// per-probe timeouts can adapt to the path instead of waiting out a
+// single hard-coded duration.
+type rttEstimator struct {
+	lock  *sync.Mutex
+	ewma  time.Duration
+	alpha float64
+}
+
+func newRTTEstimator(seed time.Duration, alpha float64) *rttEstimator {
+	return &rttEstimator{lock: new(sync.Mutex), ewma: seed, alpha: alpha}
+}
+
+func (e *rttEstimator) Update(sample time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.ewma = time.Duration(e.alpha*float64(sample) + (1-e.alpha)*float64(e.ewma))
+}
+
+func (e *rttEstimator) Estimate() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.ewma
 }
 
 type NFQueueTraceroute struct {
+	flow     flowKey
+	reporter TraceReporter
+
+	// createdAt is used by FlowTracker's eviction sweep to reap flows
+	// that have simply been around too long
+	createdAt time.Time
+
+	// lock guards every field below that processPacket, replyReceived
+	// and the per-probe timeout callbacks can touch concurrently
+	lock sync.Mutex
+
 	ttl          uint8
 	ttlMax       uint8
 	ttlRepeat    int
@@ -239,154 +1299,304 @@ type NFQueueTraceroute struct {
 	mangleFreq   int
 	count        int
 
+	// number of replies/timeouts seen so far for the current ttl; once
+	// their sum reaches ttlRepeatMax we advance immediately instead of
+	// waiting for every repeat to be individually sent
+	repliesThisTTL  int
+	timeoutsThisTTL int
+
+	rtt          *rttEstimator
+	probeHistory *probeHistory
+
 	// ip.TTL -> list of ip addrs
 	traceResult map[uint8][]net.IP
 
-	stopped          bool
-	responseTimedOut bool
+	// ip.TTL -> list of ip addrs gathered from our forged reverse-trace
+	// ICMP Echo Request probes, i.e. the server-to-client path
+	reverseTraceResult map[uint8][]net.IP
+	reverseID          uint16 // our ICMP echo id, unique per trace
+	reverseSeq         uint16
+	reverseDone        chan bool
+
+	stopped bool
 
 	// XXX should it be a pointer instead?
 	receivePacketChannel chan netfilter.NFPacket
-
-	resumeTimerChannel  chan bool
-	stopTimerChannel    chan bool
-	restartTimerChannel chan bool
 }
 
 // conduct an nfqueue tcp traceroute;
-// - send each TTL out ttlRepeatMax number of times.
+// - send each TTL out ttlRepeatMax number of times, or until
+//   ttlRepeatMax replies/timeouts have been observed for it, whichever
+//   comes first.
 // - only mangle a packet's TTL after mangleFreq number
 // of packets have traversed the flow
-func NewNFQueueTraceroute(ttlMax uint8, ttlRepeatMax, mangleFreq int) *NFQueueTraceroute {
+func NewNFQueueTraceroute(ttlMax uint8, ttlRepeatMax, mangleFreq int, flow flowKey, reporter TraceReporter) *NFQueueTraceroute {
+	return NewNFQueueTracerouteWithRTT(ttlMax, ttlRepeatMax, mangleFreq, flow, reporter, defaultRTTSeed, defaultRTTAlpha)
+}
+
+// NewNFQueueTracerouteWithRTT is like NewNFQueueTraceroute but lets the
+// caller override the RTT estimator's seed and smoothing factor; see
+// NFQueueTraceObserverOptions.rttEstimatorSeed/rttEstimatorAlpha.
+func NewNFQueueTracerouteWithRTT(ttlMax uint8, ttlRepeatMax, mangleFreq int, flow flowKey, reporter TraceReporter, rttSeed time.Duration, rttAlpha float64) *NFQueueTraceroute {
 	log.Print("NewNFQueueTraceroute\n")
 	nfqTrace := NFQueueTraceroute{
-		ttl:                 1,
-		ttlMax:              ttlMax,
-		ttlRepeat:           1,
-		ttlRepeatMax:        ttlRepeatMax,
-		mangleFreq:          mangleFreq,
-		count:               1,
-		traceResult:         make(map[uint8][]net.IP, 1),
-		stopped:             false,
-		responseTimedOut:    false,
-		stopTimerChannel:    make(chan bool),
-		restartTimerChannel: make(chan bool),
-	}
-	nfqTrace.StartResponseTimer()
+		flow:               flow,
+		reporter:           reporter,
+		createdAt:          time.Now(),
+		ttl:                1,
+		ttlMax:             ttlMax,
+		ttlRepeat:          0,
+		ttlRepeatMax:       ttlRepeatMax,
+		mangleFreq:         mangleFreq,
+		count:              1,
+		rtt:                newRTTEstimator(rttSeed, rttAlpha),
+		probeHistory:       newProbeHistory(),
+		traceResult:        make(map[uint8][]net.IP, 1),
+		reverseTraceResult: make(map[uint8][]net.IP, 1),
+		reverseID:          uint16(atomic.AddUint32(&nextReverseID, 1)),
+		reverseDone:        make(chan bool),
+		stopped:            false,
+	}
 	return &nfqTrace
 }
 
-func (n *NFQueueTraceroute) StartResponseTimer() {
-	log.Print("StartResponseTimer\n")
+// advanceTTL moves the trace on to the next TTL, resetting its
+// per-TTL repeat/reply/timeout counters. Callers must hold n.lock.
+func (n *NFQueueTraceroute) advanceTTL() {
+	n.ttl += 1
+	n.ttlRepeat = 0
+	n.repliesThisTTL = 0
+	n.timeoutsThisTTL = 0
+	if n.ttl > n.ttlMax {
+		n.markStopped()
+	}
+}
 
-	go func() {
-		for {
-			select {
-			case <-time.After(time.Duration(200) * time.Second):
-				log.Print("TimerExpired\n")
+// markStopped flips n.stopped exactly once; it's safe to call this
+// more than once (e.g. a probe timeout and an incoming reply both
+// concluding the trace at roughly the same moment). Callers must hold
+// n.lock.
+func (n *NFQueueTraceroute) markStopped() {
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	close(n.reverseDone)
+}
 
-				if n.ttl >= n.ttlMax && n.ttlRepeat >= n.ttlRepeatMax {
-					n.Stop()
-					return
-				}
+// probeTimedOut fires once key's adaptive deadline has elapsed without
+// a matching reply. If every repeat for key.ttl has now either replied
+// or timed out, the trace advances to the next TTL immediately rather
+// than waiting for mangleFreq more packets to traverse the flow.
+func (n *NFQueueTraceroute) probeTimedOut(key probeKey) {
+	n.lock.Lock()
+	if n.stopped || key.ttl != n.ttl {
+		// stale timer for a ttl we've already moved past
+		n.lock.Unlock()
+		return
+	}
+	log.Printf("probeTimedOut: ttl %d repeat %d (estimate %s)\n", key.ttl, key.repeat, n.rtt.Estimate())
+	n.timeoutsThisTTL += 1
+	if n.repliesThisTTL+n.timeoutsThisTTL >= n.ttlRepeatMax {
+		n.advanceTTL()
+	}
+	// entry above already bailed out if n.stopped was true, so seeing it
+	// true here means this call just stopped the trace
+	n.notifyIfStoppedLocked()
+}
 
-				n.responseTimedOut = true
-			case <-n.restartTimerChannel:
-				log.Print("restartTimerChannel fired\n")
-				continue
-			case <-n.stopTimerChannel:
-				log.Print("stopTimerChannel fired\n")
-				return
-			}
-		}
-	}()
+// notifyIfStoppedLocked reports the trace as complete if n.stopped is
+// set. Callers must hold n.lock and are responsible for ensuring this
+// is only reached once per stop transition. n.lock is released before
+// returning either way.
+func (n *NFQueueTraceroute) notifyIfStoppedLocked() {
+	if !n.stopped {
+		n.lock.Unlock()
+		return
+	}
+	reporter, flow, result := n.reporter, n.flow, n.traceResult
+	n.lock.Unlock()
+	if reporter != nil {
+		reporter.ReportComplete(flow, result)
+	}
 }
 
+// IsStopped reports whether the trace has finished.
+func (n *NFQueueTraceroute) IsStopped() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.stopped
+}
+
+// Stop ends the trace, idempotently: it's safe to call more than once.
 func (n *NFQueueTraceroute) Stop() {
 	log.Print("NFQueueTraceroute.Stop()\n")
-	n.stopped = true
-	n.stopTimerChannel <- true
-	close(n.stopTimerChannel)
-	close(n.restartTimerChannel)
+	n.lock.Lock()
+	wasStopped := n.stopped
+	n.markStopped()
+	if wasStopped {
+		n.lock.Unlock()
+		return
+	}
+	n.notifyIfStoppedLocked()
+}
 
+// nextReverseID hands out the per-trace ICMP echo id assigned in
+// NewNFQueueTracerouteWithRTT; using os.Getpid() here instead would
+// collide across every flow traced concurrently by this process.
+var nextReverseID uint32
+
+// nextReverseProbeID returns the (id, seq) pair to stamp on the next
+// forged reverse-trace ICMP Echo Request.
+func (n *NFQueueTraceroute) nextReverseProbeID() (uint16, uint16) {
+	n.reverseSeq += 1
+	return n.reverseID, n.reverseSeq
 }
 
-// given a packet we decided weather or not to mangle the TTL
-// for our tracerouting purposes.
-func (n *NFQueueTraceroute) processPacket(p netfilter.NFPacket) {
+// given a packet we decide whether or not to mangle the TTL for our
+// tracerouting purposes. Each mangled packet is an individual probe
+// with its own adaptive deadline; we stop minting new probes for the
+// current ttl once ttlRepeatMax of them have either replied or timed
+// out, at which point probeTimedOut/replyReceived will have already
+// advanced n.ttl.
+func (n *NFQueueTraceroute) processPacket(tp tracePacket) {
+	n.lock.Lock()
 
 	if n.stopped {
-		p.SetVerdict(netfilter.NF_ACCEPT)
+		n.lock.Unlock()
+		tp.setVerdict(netfilter.NF_ACCEPT, nil)
 		return
 	}
 
-	if n.count%n.mangleFreq == 0 {
-		log.Printf("processPacket mangle case n.ttl %d, n.ttlRepeat %d, n.ttlRepeatMax %d\n", n.ttl, n.ttlRepeat, n.ttlRepeatMax)
+	n.count += 1
+	if n.count%n.mangleFreq != 0 || n.ttlRepeat >= n.ttlRepeatMax {
+		n.lock.Unlock()
+		tp.setVerdict(netfilter.NF_ACCEPT, nil)
+		return
+	}
 
-		n.ttlRepeat += 1
+	key := probeKey{ttl: n.ttl, repeat: n.ttlRepeat}
+	n.ttlRepeat += 1
+	log.Printf("processPacket mangle case ttl %d, repeat %d, ttlRepeatMax %d\n", key.ttl, key.repeat, n.ttlRepeatMax)
 
-		if n.responseTimedOut {
-			n.ttl += 1
-			n.ttlRepeat = 0
-			n.responseTimedOut = false
-			n.restartTimerChannel <- true
-		} else if n.ttlRepeat == n.ttlRepeatMax {
-			log.Print("ttlRepeatMax reached case\n")
-			n.ttl += 1
-			n.ttlRepeat = 0
-			n.responseTimedOut = false
-			n.restartTimerChannel <- true
-		}
+	var seq uint32
+	if tcpLayer := tp.packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		seq = tcpLayer.(*layers.TCP).Seq
+	}
+	n.probeHistory.record(key, seq, time.Now())
+	time.AfterFunc(n.rtt.Estimate(), func() { n.probeTimedOut(key) })
 
-		// terminate trace upon max ttl and ttlRepeatMax conditions
-		if n.ttl > n.ttlMax && n.ttlRepeat == (n.ttlRepeatMax-1) {
-			n.Stop()
-			p.SetVerdict(netfilter.NF_ACCEPT)
-			return
-		}
+	n.lock.Unlock()
 
-		p.SetModifiedVerdict(netfilter.NF_REPEAT, serializeWithTTL(p.Packet, n.ttl))
-	} else {
-		p.SetVerdict(netfilter.NF_ACCEPT)
-	}
-	n.count = n.count + 1
+	tp.setVerdict(netfilter.NF_REPEAT, serializeWithTTL(tp.packet, key.ttl))
 }
 
 // XXX
 // store the "reply" source ip address (icmp ttl expired packet with payload matching this flow)
-func (n *NFQueueTraceroute) replyReceived(ip net.IP) {
-	log.Printf("replyReceived: ttl %d ip %s\n", n.ttl, ip.String())
+func (n *NFQueueTraceroute) replyReceived(ip net.IP, seq uint32, recvTime time.Time) {
+	n.lock.Lock()
+
+	if n.stopped {
+		n.lock.Unlock()
+		return
+	}
+
+	// recover which ttl this reply actually answers from the quoted
+	// sequence number rather than assuming it's whatever ttl we
+	// happen to be on right now -- probeTimedOut/replyReceived can
+	// advance n.ttl as soon as the current ttl's quota is met, so a
+	// reply for an older ttl can easily arrive after we've already
+	// moved on.
+	ttl := n.ttl
+	key, sendTime, ok := n.probeHistory.lookupBySeq(seq)
+	if ok {
+		ttl = key.ttl
+	} else {
+		key = probeKey{ttl: ttl, repeat: n.ttlRepeat - 1}
+		sendTime, ok = n.probeHistory.lookup(key)
+	}
+	var rtt time.Duration
+	if ok {
+		rtt = recvTime.Sub(sendTime)
+		n.rtt.Update(rtt)
+	}
+
+	log.Printf("replyReceived: ttl %d ip %s\n", ttl, ip.String())
+	n.traceResult[ttl] = append(n.traceResult[ttl], ip)
+	repeat := len(n.traceResult[ttl])
 
-	n.traceResult[n.ttl] = append(n.traceResult[n.ttl], ip)
-	if n.ttl == n.ttlMax && len(n.traceResult[n.ttl]) >= n.ttlRepeatMax {
-		n.Stop() // finished!
+	// only a reply for the ttl we're currently probing should count
+	// toward that ttl's quota -- a late reply for an older ttl just
+	// gets recorded into traceResult above, since n.repliesThisTTL/
+	// n.advanceTTL() are about deciding when to leave the *current*
+	// ttl, not about this particular reply's own ttl.
+	if ttl == n.ttl {
+		n.repliesThisTTL += 1
+		if n.repliesThisTTL+n.timeoutsThisTTL >= n.ttlRepeatMax {
+			n.advanceTTL()
+		}
+	}
+
+	// entry above already bailed out if n.stopped was true, so seeing it
+	// true here -- same as probeTimedOut -- means advanceTTL just
+	// stopped the trace and we still owe the reporter a complete event,
+	// in addition to the hop we're about to report
+	reporter, flow, result, stopped := n.reporter, n.flow, n.traceResult, n.stopped
+	n.lock.Unlock()
+
+	if reporter != nil {
+		reporter.ReportHop(flow, DirectionForward, ttl, repeat, ip, rtt)
+		if stopped {
+			reporter.ReportComplete(flow, result)
+		}
+	}
+}
+
+// store the reverse-path "reply" source ip address for the given ttl,
+// as learned from a Time Exceeded reply to one of our forged ICMP Echo
+// Request probes.
+func (n *NFQueueTraceroute) reverseReplyReceived(ttl uint8, ip net.IP, rtt time.Duration) {
+	log.Printf("reverseReplyReceived: ttl %d ip %s\n", ttl, ip.String())
+	n.reverseTraceResult[ttl] = append(n.reverseTraceResult[ttl], ip)
+	if n.reporter != nil {
+		n.reporter.ReportHop(n.flow, DirectionReverse, ttl, len(n.reverseTraceResult[ttl]), ip, rtt)
 	}
 }
 
 // This function takes a gopacket.Packet and a TTL
 // and returns a byte array of the serialized packet with the specified TTL
+// (the IPv4 TTL field, or the IPv6 Hop Limit field for v6 packets)
 func serializeWithTTL(p gopacket.Packet, ttl uint8) []byte {
-	ipLayer := p.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
-		return nil
-	}
 	tcpLayer := p.Layer(layers.LayerTypeTCP)
 	if tcpLayer == nil {
 		return nil
 	}
-	ip, _ := ipLayer.(*layers.IPv4)
-	ip.TTL = ttl
 	tcp, _ := tcpLayer.(*layers.TCP)
 	opts := gopacket.SerializeOptions{
 		FixLengths:       true,
 		ComputeChecksums: true,
 	}
-	tcp.SetNetworkLayerForChecksum(ip)
 	rawPacketBuf := gopacket.NewSerializeBuffer()
-	if err := gopacket.SerializeLayers(rawPacketBuf, opts, ip, tcp); err != nil {
-		return nil
+
+	if ipLayer := p.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip, _ := ipLayer.(*layers.IPv4)
+		ip.TTL = ttl
+		tcp.SetNetworkLayerForChecksum(ip)
+		if err := gopacket.SerializeLayers(rawPacketBuf, opts, ip, tcp); err != nil {
+			return nil
+		}
+		return rawPacketBuf.Bytes()
+	}
+	if ip6Layer := p.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
+		ip6, _ := ip6Layer.(*layers.IPv6)
+		ip6.HopLimit = ttl
+		tcp.SetNetworkLayerForChecksum(ip6)
+		if err := gopacket.SerializeLayers(rawPacketBuf, opts, ip6, tcp); err != nil {
+			return nil
+		}
+		return rawPacketBuf.Bytes()
 	}
-	return rawPacketBuf.Bytes()
+	return nil
 }
 
 // We use this to deal with rfc792 implementations where
@@ -411,8 +1621,104 @@ func getTCPFlowFromTCPHead(data []byte) gopacket.Flow {
 	return tcpFlow
 }
 
-// given a byte array packet return a tcp/ip flow
+// getICMPEchoFromHead inspects the quoted inner packet of an ICMP Time
+// Exceeded message and, if it quotes one of our forged reverse-trace
+// ICMP Echo Requests, returns its identifier and sequence number.
+// Handles the RFC 792 "64 bits only" case the same way
+// getTCPFlowFromTCPHead does for TCP: the inner IPv4 header (20 bytes,
+// no options) is followed by only the first 8 bytes of the ICMP
+// header, which is exactly enough to recover Id/Seq.
+func getICMPEchoFromHead(data []byte) (uint16, uint16, bool) {
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return getICMPv6EchoFromHead(data)
+	}
+
+	var ip layers.IPv4
+	var icmp layers.ICMPv4
+	decoded := []gopacket.LayerType{}
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip, &icmp)
+	if err := parser.DecodeLayers(data, &decoded); err == nil {
+		if ip.Protocol == layers.IPProtocolICMPv4 {
+			typ := uint8(icmp.TypeCode >> 8)
+			if typ == layers.ICMPv4TypeEchoRequest {
+				return icmp.Id, icmp.Seq, true
+			}
+		}
+		return 0, 0, false
+	}
+
+	// not enough bytes for a full ICMPv4 layer decode; try the RFC 792
+	// minimum quoting case: 20 byte IP header + 8 byte ICMP header
+	if len(data) < 20+8 {
+		return 0, 0, false
+	}
+	ipHeaderLen := int(data[0]&0x0f) * 4
+	if ipHeaderLen == 0 || len(data) < ipHeaderLen+8 {
+		return 0, 0, false
+	}
+	if data[9] != byte(layers.IPProtocolICMPv4) {
+		return 0, 0, false
+	}
+	icmpHead := data[ipHeaderLen:]
+	if icmpHead[0] != layers.ICMPv4TypeEchoRequest {
+		return 0, 0, false
+	}
+	id := binary.BigEndian.Uint16(icmpHead[4:6])
+	seq := binary.BigEndian.Uint16(icmpHead[6:8])
+	return id, seq, true
+}
+
+// getICMPv6EchoFromHead is getICMPEchoFromHead's IPv6 branch: RFC 4443
+// routers quote enough of the original packet that there's no RFC
+// 792-style truncated case to special-case here.
+func getICMPv6EchoFromHead(data []byte) (uint16, uint16, bool) {
+	var ip6 layers.IPv6
+	var icmp6 layers.ICMPv6
+	var echo layers.ICMPv6Echo
+	decoded := []gopacket.LayerType{}
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &ip6, &icmp6, &echo)
+	if err := parser.DecodeLayers(data, &decoded); err != nil {
+		return 0, 0, false
+	}
+	if ip6.NextHeader != layers.IPProtocolICMPv6 || uint8(icmp6.TypeCode>>8) != layers.ICMPv6TypeEchoRequest {
+		return 0, 0, false
+	}
+	return echo.Identifier, echo.SeqNumber, true
+}
+
+// getQuotedTCPSeq recovers the original TCP sequence number from the
+// quoted inner packet of an ICMP Time Exceeded reply -- the same
+// bytes getPacketFlow decodes -- so replyReceived can look the probe
+// up in probeHistory by seq and find out which ttl it actually
+// mangled, rather than assuming it was whatever ttl the trace is on
+// when the reply shows up.
+func getQuotedTCPSeq(packet []byte) (uint32, bool) {
+	if len(packet) == 0 {
+		return 0, false
+	}
+	ipHeaderLen := 40
+	if packet[0]>>4 != 6 {
+		ipHeaderLen = int(packet[0]&0x0f) * 4
+	}
+	if ipHeaderLen == 0 || len(packet) < ipHeaderLen+8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(packet[ipHeaderLen+4 : ipHeaderLen+8]), true
+}
+
+// given a byte array packet return a tcp/ip flow, branching on the IP
+// version encoded in the first nibble
 func getPacketFlow(packet []byte) flowKey {
+	if len(packet) == 0 {
+		return flowKey{}
+	}
+	if packet[0]>>4 == 6 {
+		return getPacketFlowV6(packet)
+	}
+	return getPacketFlowV4(packet)
+}
+
+func getPacketFlowV4(packet []byte) flowKey {
 	var ip layers.IPv4
 	var tcp layers.TCP
 	decoded := []gopacket.LayerType{}
@@ -427,6 +1733,23 @@ func getPacketFlow(packet []byte) flowKey {
 	return flowKey{ip.NetworkFlow(), tcp.TransportFlow()}
 }
 
+// getPacketFlowV6 decodes the IPv6/TCP flow quoted by an ICMPv6 Time
+// Exceeded message. Unlike ICMPv4, RFC 4443 requires routers to quote
+// as much of the original packet as fits without the reply exceeding
+// the minimum IPv6 MTU, so the fixed 40 byte IPv6 header plus a full
+// TCP header is reliably present and there's no RFC 792-style 64 bit
+// truncation case to special-case here.
+func getPacketFlowV6(packet []byte) flowKey {
+	var ip6 layers.IPv6
+	var tcp layers.TCP
+	decoded := []gopacket.LayerType{}
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &ip6, &tcp)
+	if err := parser.DecodeLayers(packet, &decoded); err != nil {
+		return flowKey{}
+	}
+	return flowKey{ip6.NetworkFlow(), tcp.TransportFlow()}
+}
+
 /***
 use this rough POC with an iptables nfqueue rule that will select
 a tcp flow direction like this:
@@ -435,10 +1758,12 @@ iptables -A OUTPUT -j NFQUEUE --queue-num 0 -p tcp --dport 2666
 ***/
 func main() {
 	options := NFQueueTraceObserverOptions{
-		iface:        "wlan0",
-		ttlMax:       40,
-		ttlRepeatMax: 3,
-		mangleFreq:   6,
+		iface:               "wlan0",
+		ttlMax:              40,
+		ttlRepeatMax:        3,
+		mangleFreq:          6,
+		reverseTraceEnabled: true,
+		reverseProbeFreq:    time.Second,
 	}
 	o := NewNFQueueTraceObserver(options)
 	o.Start()